@@ -20,15 +20,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pingcap/tidb-operator/pkg/apis/pingcap/v1alpha1"
 	"github.com/pingcap/tidb-operator/pkg/util"
 	httputil "github.com/pingcap/tidb-operator/pkg/util/http"
 	"github.com/pingcap/tidb/config"
+	"github.com/pingcap/tidb/model"
+	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
 )
 
 const (
@@ -36,8 +45,37 @@ const (
 	// NotDDLOwnerError is the error message which was returned when the tidb node is not a ddl owner
 	NotDDLOwnerError = "This node is not a ddl owner, can't be resigned."
 	timeout          = 5 * time.Second
+	// maxIdleConnsPerHost bounds the idle connection pool kept per TiDB instance so that
+	// repeated polling of the same pod across reconciles reuses TLS handshakes.
+	maxIdleConnsPerHost = 20
 )
 
+var (
+	tidbControlRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidb_operator",
+			Subsystem: "tidb_control",
+			Name:      "request_duration_seconds",
+			Help:      "Duration in seconds of HTTP requests made to the TiDB status port, by endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+	tidbControlRequestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb_operator",
+			Subsystem: "tidb_control",
+			Name:      "request_errors_total",
+			Help:      "Total number of failed HTTP requests made to the TiDB status port, by endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tidbControlRequestDuration)
+	prometheus.MustRegister(tidbControlRequestErrors)
+}
+
 type DBInfo struct {
 	IsOwner bool `json:"is_owner"`
 }
@@ -50,18 +88,84 @@ type TiDBControlInterface interface {
 	GetInfo(tc *v1alpha1.TidbCluster, ordinal int32) (*DBInfo, error)
 	// GetSettings return the TiDB instance settings
 	GetSettings(tc *v1alpha1.TidbCluster, ordinal int32) (*config.Config, error)
+	// ResignDDLOwner resigns the DDL owner of the TiDB instance, if any. A
+	// pod that is not the DDL owner has nothing to resign, so that case is
+	// reported as resigned=true, err=nil rather than as a failure, letting
+	// callers invoke it unconditionally on every pod during an upgrade.
+	ResignDDLOwner(tc *v1alpha1.TidbCluster, ordinal int32) (resigned bool, err error)
+	// GetSchemaVersion returns the schema version currently loaded by the TiDB instance
+	GetSchemaVersion(tc *v1alpha1.TidbCluster, ordinal int32) (int64, error)
+	// GetDDLJobs returns the DDL jobs known to the TiDB instance
+	GetDDLJobs(tc *v1alpha1.TidbCluster, ordinal int32) ([]*model.Job, error)
+	// GetStatsDump returns the statistics dump of the given table
+	GetStatsDump(tc *v1alpha1.TidbCluster, ordinal int32, db, table string) (map[string]interface{}, error)
+}
+
+// tidbClientCacheKey identifies the cached HTTP client for a cluster's client TLS secret
+type tidbClientCacheKey struct {
+	namespace string
+	secret    string
+}
+
+// cachedTiDBClient pairs a built HTTP client with the ResourceVersion of the
+// Secret it was built from, so a cache hit only needs to compare strings.
+type cachedTiDBClient struct {
+	resourceVersion string
+	client          *http.Client
 }
 
 // defaultTiDBControl is default implementation of TiDBControlInterface.
 type defaultTiDBControl struct {
-	kubeCli kubernetes.Interface
+	kubeCli      kubernetes.Interface
+	secretLister corelisters.SecretLister
 	// for unit test only
 	testURL string
+
+	mu      sync.RWMutex
+	clients map[tidbClientCacheKey]*cachedTiDBClient
+}
+
+// NewDefaultTiDBControl returns a defaultTiDBControl instance. secretInformer is watched
+// so that a client TLS secret rotation invalidates the cached HTTP client for that
+// cluster without requiring a process restart.
+func NewDefaultTiDBControl(kubeCli kubernetes.Interface, secretInformer coreinformers.SecretInformer) *defaultTiDBControl {
+	tdc := &defaultTiDBControl{
+		kubeCli:      kubeCli,
+		secretLister: secretInformer.Lister(),
+		clients:      make(map[tidbClientCacheKey]*cachedTiDBClient),
+	}
+	secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, cur interface{}) {
+			tdc.invalidateSecret(cur)
+		},
+		DeleteFunc: tdc.invalidateSecret,
+	})
+	return tdc
 }
 
-// NewDefaultTiDBControl returns a defaultTiDBControl instance
-func NewDefaultTiDBControl(kubeCli kubernetes.Interface) *defaultTiDBControl {
-	return &defaultTiDBControl{kubeCli: kubeCli}
+// invalidateSecret drops the cached HTTP client for the Secret's namespace/name, if any.
+func (tdc *defaultTiDBControl) invalidateSecret(obj interface{}) {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("unexpected object type %T in secret invalidation handler", obj))
+			return
+		}
+		secret, ok = tombstone.Obj.(*v1.Secret)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("unexpected tombstone object type %T in secret invalidation handler", tombstone.Obj))
+			return
+		}
+	}
+
+	key := tidbClientCacheKey{namespace: secret.Namespace, secret: secret.Name}
+	tdc.mu.Lock()
+	defer tdc.mu.Unlock()
+	if _, ok := tdc.clients[key]; ok {
+		klog.Infof("invalidating cached TiDB HTTP client for secret %s/%s", secret.Namespace, secret.Name)
+		delete(tdc.clients, key)
+	}
 }
 
 func (tdc *defaultTiDBControl) GetHealth(tc *v1alpha1.TidbCluster, ordinal int32) (bool, error) {
@@ -72,7 +176,7 @@ func (tdc *defaultTiDBControl) GetHealth(tc *v1alpha1.TidbCluster, ordinal int32
 
 	baseURL := tdc.getBaseURL(tc, ordinal)
 	url := fmt.Sprintf("%s/status", baseURL)
-	_, err = getBodyOK(httpClient, url)
+	_, err = getBodyOK(httpClient, "health", url)
 	return err == nil, nil
 }
 
@@ -88,12 +192,13 @@ func (tdc *defaultTiDBControl) GetInfo(tc *v1alpha1.TidbCluster, ordinal int32)
 	if err != nil {
 		return nil, err
 	}
-	res, err := httpClient.Do(req)
+	res, err := doInstrumented(httpClient, "info", req)
 	if err != nil {
 		return nil, err
 	}
 	defer httputil.DeferClose(res.Body)
 	if res.StatusCode != http.StatusOK {
+		tidbControlRequestErrors.WithLabelValues("info").Inc()
 		errMsg := fmt.Errorf(fmt.Sprintf("Error response %v URL: %s", res.StatusCode, url))
 		return nil, errMsg
 	}
@@ -121,12 +226,13 @@ func (tdc *defaultTiDBControl) GetSettings(tc *v1alpha1.TidbCluster, ordinal int
 	if err != nil {
 		return nil, err
 	}
-	res, err := httpClient.Do(req)
+	res, err := doInstrumented(httpClient, "settings", req)
 	if err != nil {
 		return nil, err
 	}
 	defer httputil.DeferClose(res.Body)
 	if res.StatusCode != http.StatusOK {
+		tidbControlRequestErrors.WithLabelValues("settings").Inc()
 		errMsg := fmt.Errorf(fmt.Sprintf("Error response %v URL: %s", res.StatusCode, url))
 		return nil, errMsg
 	}
@@ -142,12 +248,118 @@ func (tdc *defaultTiDBControl) GetSettings(tc *v1alpha1.TidbCluster, ordinal int
 	return &info, nil
 }
 
-func getBodyOK(httpClient *http.Client, apiURL string) ([]byte, error) {
+func (tdc *defaultTiDBControl) ResignDDLOwner(tc *v1alpha1.TidbCluster, ordinal int32) (bool, error) {
+	httpClient, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		return false, err
+	}
+
+	baseURL := tdc.getBaseURL(tc, ordinal)
+	url := fmt.Sprintf("%s/ddl/owner/resign", baseURL)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := doInstrumented(httpClient, "ddl_owner_resign", req)
+	if err != nil {
+		return false, err
+	}
+	defer httputil.DeferClose(res.Body)
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(string(body), NotDDLOwnerError) {
+		// the pod was never the DDL owner, so there is nothing to resign
+		return true, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		tidbControlRequestErrors.WithLabelValues("ddl_owner_resign").Inc()
+		return false, fmt.Errorf(fmt.Sprintf("Error response %v URL: %s", res.StatusCode, url))
+	}
+	return true, nil
+}
+
+func (tdc *defaultTiDBControl) GetSchemaVersion(tc *v1alpha1.TidbCluster, ordinal int32) (int64, error) {
+	httpClient, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		return 0, err
+	}
+
+	baseURL := tdc.getBaseURL(tc, ordinal)
+	url := fmt.Sprintf("%s/schema/version", baseURL)
+	body, err := getBodyOK(httpClient, "schema_version", url)
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse schema version response from %s: %v", url, err)
+	}
+	return version, nil
+}
+
+func (tdc *defaultTiDBControl) GetDDLJobs(tc *v1alpha1.TidbCluster, ordinal int32) ([]*model.Job, error) {
+	httpClient, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := tdc.getBaseURL(tc, ordinal)
+	url := fmt.Sprintf("%s/ddl/jobs", baseURL)
+	body, err := getBodyOK(httpClient, "ddl_jobs", url)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*model.Job
+	if err := json.Unmarshal(body, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (tdc *defaultTiDBControl) GetStatsDump(tc *v1alpha1.TidbCluster, ordinal int32, db, table string) (map[string]interface{}, error) {
+	httpClient, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := tdc.getBaseURL(tc, ordinal)
+	url := fmt.Sprintf("%s/stats/dump/%s/%s", baseURL, db, table)
+	body, err := getBodyOK(httpClient, "stats_dump", url)
+	if err != nil {
+		return nil, err
+	}
+	dump := make(map[string]interface{})
+	if err := json.Unmarshal(body, &dump); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// doInstrumented performs req on httpClient, recording its latency under endpoint
+// and incrementing the endpoint's error counter on transport-level failure.
+func doInstrumented(httpClient *http.Client, endpoint string, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := httpClient.Do(req)
+	tidbControlRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		tidbControlRequestErrors.WithLabelValues(endpoint).Inc()
+		return nil, err
+	}
+	return res, nil
+}
+
+func getBodyOK(httpClient *http.Client, endpoint, apiURL string) ([]byte, error) {
+	start := time.Now()
 	res, err := httpClient.Get(apiURL)
+	tidbControlRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
 	if err != nil {
+		tidbControlRequestErrors.WithLabelValues(endpoint).Inc()
 		return nil, err
 	}
 	if res.StatusCode >= 400 {
+		tidbControlRequestErrors.WithLabelValues(endpoint).Inc()
 		errMsg := fmt.Errorf(fmt.Sprintf("Error response %v URL %s", res.StatusCode, apiURL))
 		return nil, errMsg
 	}
@@ -161,19 +373,38 @@ func getBodyOK(httpClient *http.Client, apiURL string) ([]byte, error) {
 }
 
 func (tdc *defaultTiDBControl) getHTTPClient(tc *v1alpha1.TidbCluster) (*http.Client, error) {
-	httpClient := &http.Client{Timeout: timeout}
 	if !tc.IsTLSClusterEnabled() {
-		return httpClient, nil
+		return &http.Client{Timeout: timeout}, nil
 	}
 
-	tcName := tc.Name
 	ns := tc.Namespace
-	secretName := util.ClusterClientTLSSecretName(tcName)
-	secret, err := tdc.kubeCli.CoreV1().Secrets(ns).Get(secretName, metav1.GetOptions{})
+	secretName := util.ClusterClientTLSSecretName(tc.Name)
+	secret, err := tdc.secretLister.Secrets(ns).Get(secretName)
 	if err != nil {
 		return nil, err
 	}
 
+	key := tidbClientCacheKey{namespace: ns, secret: secretName}
+	tdc.mu.RLock()
+	cached, ok := tdc.clients[key]
+	tdc.mu.RUnlock()
+	if ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.client, nil
+	}
+
+	httpClient, err := buildTLSHTTPClient(secret, ns, secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	tdc.mu.Lock()
+	tdc.clients[key] = &cachedTiDBClient{resourceVersion: secret.ResourceVersion, client: httpClient}
+	tdc.mu.Unlock()
+
+	return httpClient, nil
+}
+
+func buildTLSHTTPClient(secret *v1.Secret, ns, secretName string) (*http.Client, error) {
 	clientCert, certExists := secret.Data[v1.TLSCertKey]
 	clientKey, keyExists := secret.Data[v1.TLSPrivateKeyKey]
 	if !certExists || !keyExists {
@@ -187,13 +418,18 @@ func (tdc *defaultTiDBControl) getHTTPClient(tc *v1alpha1.TidbCluster) (*http.Cl
 
 	rootCAs := x509.NewCertPool()
 	rootCAs.AppendCertsFromPEM(secret.Data[v1.ServiceAccountRootCAKey])
-	config := &tls.Config{
+	tlsConfig := &tls.Config{
 		RootCAs:      rootCAs,
 		Certificates: []tls.Certificate{tlsCert},
 	}
-	httpClient.Transport = &http.Transport{TLSClientConfig: config}
 
-	return httpClient, nil
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		},
+	}, nil
 }
 
 func (tdc *defaultTiDBControl) getBaseURL(tc *v1alpha1.TidbCluster, ordinal int32) string {
@@ -211,10 +447,19 @@ func (tdc *defaultTiDBControl) getBaseURL(tc *v1alpha1.TidbCluster, ordinal int3
 
 // FakeTiDBControl is a fake implementation of TiDBControlInterface.
 type FakeTiDBControl struct {
-	healthInfo   map[string]bool
-	tiDBInfo     *DBInfo
-	getInfoError error
-	tidbConfig   *config.Config
+	healthInfo        map[string]bool
+	tiDBInfo          *DBInfo
+	getInfoError      error
+	tidbConfig        *config.Config
+	resignDDLOwner    bool
+	resignDDLOwnerErr error
+	schemaVersion     int64
+	schemaVersionErr  error
+	ddlJobs           []*model.Job
+	ddlJobsErr        error
+	statsDump         map[string]interface{}
+	statsDumpErr      error
+	invalidatedCaches []tidbClientCacheKey
 }
 
 // NewFakeTiDBControl returns a FakeTiDBControl instance
@@ -222,6 +467,18 @@ func NewFakeTiDBControl() *FakeTiDBControl {
 	return &FakeTiDBControl{}
 }
 
+// InvalidateCacheForSecret records that a Secret update/delete was observed for
+// namespace/secret, mirroring defaultTiDBControl's real cache invalidation so
+// tests can assert on it without standing up a SecretInformer.
+func (ftd *FakeTiDBControl) InvalidateCacheForSecret(namespace, secret string) {
+	ftd.invalidatedCaches = append(ftd.invalidatedCaches, tidbClientCacheKey{namespace: namespace, secret: secret})
+}
+
+// InvalidatedCaches returns the namespace/secret pairs passed to InvalidateCacheForSecret
+func (ftd *FakeTiDBControl) InvalidatedCaches() []tidbClientCacheKey {
+	return ftd.invalidatedCaches
+}
+
 // SetHealth set health info for FakeTiDBControl
 func (ftd *FakeTiDBControl) SetHealth(healthInfo map[string]bool) {
 	ftd.healthInfo = healthInfo
@@ -245,3 +502,43 @@ func (ftd *FakeTiDBControl) GetInfo(tc *v1alpha1.TidbCluster, ordinal int32) (*D
 func (ftd *FakeTiDBControl) GetSettings(tc *v1alpha1.TidbCluster, ordinal int32) (*config.Config, error) {
 	return ftd.tidbConfig, ftd.getInfoError
 }
+
+// SetResignDDLOwner sets the resign result for FakeTiDBControl
+func (ftd *FakeTiDBControl) SetResignDDLOwner(resigned bool, err error) {
+	ftd.resignDDLOwner = resigned
+	ftd.resignDDLOwnerErr = err
+}
+
+func (ftd *FakeTiDBControl) ResignDDLOwner(tc *v1alpha1.TidbCluster, ordinal int32) (bool, error) {
+	return ftd.resignDDLOwner, ftd.resignDDLOwnerErr
+}
+
+// SetSchemaVersion sets the schema version for FakeTiDBControl
+func (ftd *FakeTiDBControl) SetSchemaVersion(version int64, err error) {
+	ftd.schemaVersion = version
+	ftd.schemaVersionErr = err
+}
+
+func (ftd *FakeTiDBControl) GetSchemaVersion(tc *v1alpha1.TidbCluster, ordinal int32) (int64, error) {
+	return ftd.schemaVersion, ftd.schemaVersionErr
+}
+
+// SetDDLJobs sets the DDL jobs for FakeTiDBControl
+func (ftd *FakeTiDBControl) SetDDLJobs(jobs []*model.Job, err error) {
+	ftd.ddlJobs = jobs
+	ftd.ddlJobsErr = err
+}
+
+func (ftd *FakeTiDBControl) GetDDLJobs(tc *v1alpha1.TidbCluster, ordinal int32) ([]*model.Job, error) {
+	return ftd.ddlJobs, ftd.ddlJobsErr
+}
+
+// SetStatsDump sets the stats dump for FakeTiDBControl
+func (ftd *FakeTiDBControl) SetStatsDump(dump map[string]interface{}, err error) {
+	ftd.statsDump = dump
+	ftd.statsDumpErr = err
+}
+
+func (ftd *FakeTiDBControl) GetStatsDump(tc *v1alpha1.TidbCluster, ordinal int32, db, table string) (map[string]interface{}, error) {
+	return ftd.statsDump, ftd.statsDumpErr
+}
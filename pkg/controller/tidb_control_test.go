@@ -0,0 +1,215 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb-operator/pkg/apis/pingcap/v1alpha1"
+	"github.com/pingcap/tidb-operator/pkg/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestTiDBControl(t *testing.T, server *httptest.Server) *defaultTiDBControl {
+	t.Helper()
+	return &defaultTiDBControl{testURL: server.URL}
+}
+
+func TestResignDDLOwnerTreatsNotOwnerAsResigned(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(NotDDLOwnerError))
+	}))
+	defer server.Close()
+
+	tdc := newTestTiDBControl(t, server)
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+
+	resigned, err := tdc.ResignDDLOwner(tc, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resigned {
+		t.Error("expected a pod that was never the DDL owner to be reported as resigned")
+	}
+}
+
+func TestResignDDLOwnerFailsOnOtherErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	}))
+	defer server.Close()
+
+	tdc := newTestTiDBControl(t, server)
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+
+	resigned, err := tdc.ResignDDLOwner(tc, 0)
+	if err == nil {
+		t.Fatal("expected an error for a non-NotDDLOwnerError failure response")
+	}
+	if resigned {
+		t.Error("expected resigned=false on failure")
+	}
+}
+
+func TestGetSchemaVersionParsesResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("42"))
+	}))
+	defer server.Close()
+
+	tdc := newTestTiDBControl(t, server)
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+
+	version, err := tdc.GetSchemaVersion(tc, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != 42 {
+		t.Errorf("expected schema version 42, got %d", version)
+	}
+}
+
+func TestGetSchemaVersionRejectsNonNumericResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not-a-number"))
+	}))
+	defer server.Close()
+
+	tdc := newTestTiDBControl(t, server)
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+
+	if _, err := tdc.GetSchemaVersion(tc, 0); err == nil {
+		t.Error("expected an error for a non-numeric schema version response")
+	}
+}
+
+func TestFakeTiDBControlRecordsInvalidatedCaches(t *testing.T) {
+	ftd := NewFakeTiDBControl()
+
+	ftd.InvalidateCacheForSecret("ns", "secret-a")
+	ftd.InvalidateCacheForSecret("ns", "secret-b")
+
+	got := ftd.InvalidatedCaches()
+	want := []tidbClientCacheKey{
+		{namespace: "ns", secret: "secret-a"},
+		{namespace: "ns", secret: "secret-b"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d invalidated caches, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("invalidated cache %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+// newTestTLSSecret returns a Secret holding a freshly generated self-signed
+// client cert/key pair, valid enough for tls.X509KeyPair to accept.
+func newTestTLSSecret(t *testing.T, ns, name, resourceVersion string) *v1.Secret {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, ResourceVersion: resourceVersion},
+		Data: map[string][]byte{
+			v1.TLSCertKey:       certPEM,
+			v1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+}
+
+// TestGetHTTPClientCachesByResourceVersionAndInvalidates drives the real
+// defaultTiDBControl.getHTTPClient/invalidateSecret pair end-to-end: a second
+// call with the same Secret ResourceVersion must return the identical cached
+// *http.Client, and a call after invalidateSecret fires (as it would from the
+// SecretInformer's Update/DeleteFunc) must build a new one.
+func TestGetHTTPClientCachesByResourceVersionAndInvalidates(t *testing.T) {
+	ns := "ns"
+	tcName := "tc"
+	secretName := util.ClusterClientTLSSecretName(tcName)
+	secret := newTestTLSSecret(t, ns, secretName, "1")
+
+	kubeCli := kubefake.NewSimpleClientset(secret)
+	informerFactory := kubeinformers.NewSharedInformerFactory(kubeCli, 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("failed to seed secret lister: %v", err)
+	}
+
+	tdc := NewDefaultTiDBControl(kubeCli, secretInformer)
+	tc := &v1alpha1.TidbCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: tcName},
+		Spec:       v1alpha1.TidbClusterSpec{TLSCluster: &v1alpha1.TLSCluster{Enabled: true}},
+	}
+
+	client1, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		t.Fatalf("unexpected error building the first client: %v", err)
+	}
+	client2, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		t.Fatalf("unexpected error on the cache-hit call: %v", err)
+	}
+	if client1 != client2 {
+		t.Error("expected getHTTPClient to return the cached *http.Client for an unchanged Secret ResourceVersion")
+	}
+
+	// mirror what the SecretInformer's Update/DeleteFunc does on a Secret event
+	tdc.invalidateSecret(secret)
+
+	client3, err := tdc.getHTTPClient(tc)
+	if err != nil {
+		t.Fatalf("unexpected error after invalidation: %v", err)
+	}
+	if client3 == client1 {
+		t.Error("expected invalidateSecret to evict the cached client and force a rebuild")
+	}
+}
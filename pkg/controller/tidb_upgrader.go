@@ -0,0 +1,121 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/pingcap/tidb-operator/pkg/apis/pingcap/v1alpha1"
+	apps "k8s.io/api/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+)
+
+// TiDBUpgrader knows how to walk a TiDB StatefulSet's pods down from the highest
+// ordinal to the lowest during a rolling upgrade, resigning the DDL owner off a
+// pod immediately before it is restarted and refusing to advance the partition
+// past a pod until every already-upgraded replica has converged on the new
+// schema version. A failed resignation is logged and does not block the restart.
+type TiDBUpgrader interface {
+	Upgrade(tc *v1alpha1.TidbCluster, oldSet, newSet *apps.StatefulSet) error
+}
+
+type tidbUpgrader struct {
+	tidbControl TiDBControlInterface
+	podLister   corelisters.PodLister
+}
+
+// NewTiDBUpgrader returns a TiDBUpgrader
+func NewTiDBUpgrader(tidbControl TiDBControlInterface, podLister corelisters.PodLister) TiDBUpgrader {
+	return &tidbUpgrader{
+		tidbControl: tidbControl,
+		podLister:   podLister,
+	}
+}
+
+func (tu *tidbUpgrader) Upgrade(tc *v1alpha1.TidbCluster, oldSet, newSet *apps.StatefulSet) error {
+	ns := tc.GetNamespace()
+	tcName := tc.GetName()
+
+	if newSet.Spec.Replicas == nil {
+		return nil
+	}
+	replicas := *newSet.Spec.Replicas
+
+	for i := replicas - 1; i >= 0; i-- {
+		podName := fmt.Sprintf("%s-%d", TiDBMemberName(tcName), i)
+		pod, err := tu.podLister.Pods(ns).Get(podName)
+		if err != nil {
+			return fmt.Errorf("tidbUpgrader.Upgrade: failed to get pod %s/%s for tidbcluster %s/%s, error: %v", ns, podName, ns, tcName, err)
+		}
+
+		revision, exist := pod.Labels[apps.ControllerRevisionHashLabelKey]
+		if exist && revision == newSet.Status.UpdateRevision {
+			// already on the new revision, keep walking down to find the next pod pending upgrade
+			continue
+		}
+
+		// pod i is the next one the StatefulSet controller will restart once the
+		// partition is lowered to i; refuse to do that until every replica already
+		// on the new revision has converged on the same schema version, so this
+		// restart can't race an in-flight DDL on those replicas
+		converged, err := tu.schemaVersionsConverged(tc, i+1, replicas)
+		if err != nil {
+			return err
+		}
+		if !converged {
+			return fmt.Errorf("tidbUpgrader.Upgrade: schema versions of tidbcluster %s/%s have not converged, can not upgrade pod %s yet", ns, tcName, podName)
+		}
+
+		if resigned, err := tu.tidbControl.ResignDDLOwner(tc, i); err != nil || !resigned {
+			klog.Warningf("tidbUpgrader.Upgrade: failed to resign DDL owner of pod %s/%s before restart, error: %v", ns, podName, err)
+		}
+
+		return setStatefulSetPartition(newSet, i)
+	}
+
+	// every pod is already on the new revision
+	return setStatefulSetPartition(newSet, 0)
+}
+
+// schemaVersionsConverged reports whether every replica in [from, replicas), i.e.
+// the ones already upgraded to the new revision, have loaded the same schema
+// version. An upgrade with no already-upgraded replicas trivially converges.
+func (tu *tidbUpgrader) schemaVersionsConverged(tc *v1alpha1.TidbCluster, from, replicas int32) (bool, error) {
+	var want int64
+	for ordinal := from; ordinal < replicas; ordinal++ {
+		version, err := tu.tidbControl.GetSchemaVersion(tc, ordinal)
+		if err != nil {
+			return false, fmt.Errorf("tidbUpgrader: failed to get schema version of %s-%d: %v", TiDBMemberName(tc.GetName()), ordinal, err)
+		}
+		if ordinal == from {
+			want = version
+			continue
+		}
+		if version != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// setStatefulSetPartition sets set's RollingUpdate.Partition to partition, the
+// same mechanism realTiKVGroupControl.updatePartition uses to canary a TiKVGroup.
+func setStatefulSetPartition(set *apps.StatefulSet, partition int32) error {
+	if set.Spec.UpdateStrategy.RollingUpdate == nil {
+		set.Spec.UpdateStrategy.RollingUpdate = &apps.RollingUpdateStatefulSetStrategy{}
+	}
+	set.Spec.UpdateStrategy.RollingUpdate.Partition = &partition
+	return nil
+}
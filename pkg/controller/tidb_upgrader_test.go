@@ -0,0 +1,140 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pingcap/tidb-operator/pkg/apis/pingcap/v1alpha1"
+	apps "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	oldRevision = "old-revision"
+	newRevision = "new-revision"
+)
+
+func newTiDBUpgraderTestPod(ns, name, revision string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ns,
+			Name:      name,
+			Labels:    map[string]string{apps.ControllerRevisionHashLabelKey: revision},
+		},
+	}
+}
+
+// newTiDBUpgraderTestLister returns a PodLister whose indexer already contains pods,
+// without starting an informer, so tests run synchronously.
+func newTiDBUpgraderTestLister(pods ...*v1.Pod) corelisters.PodLister {
+	kubeCli := kubefake.NewSimpleClientset()
+	informerFactory := kubeinformers.NewSharedInformerFactory(kubeCli, 0)
+	podInformer := informerFactory.Core().V1().Pods()
+	for _, pod := range pods {
+		podInformer.Informer().GetIndexer().Add(pod)
+	}
+	return podInformer.Lister()
+}
+
+func newTiDBUpgraderTestStatefulSet(ns, name string, replicas int32, updateRevision string) *apps.StatefulSet {
+	return &apps.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec:       apps.StatefulSetSpec{Replicas: &replicas},
+		Status:     apps.StatefulSetStatus{UpdateRevision: updateRevision},
+	}
+}
+
+func TestTiDBUpgraderResignsOwnerAndSetsPartitionOnFirstPendingPod(t *testing.T) {
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+	// ordinal 2 already on the new revision, 1 and 0 still pending
+	pods := []*v1.Pod{
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-2", TiDBMemberName("tc")), newRevision),
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-1", TiDBMemberName("tc")), oldRevision),
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-0", TiDBMemberName("tc")), oldRevision),
+	}
+	podLister := newTiDBUpgraderTestLister(pods...)
+
+	tidbControl := NewFakeTiDBControl()
+	tidbControl.SetSchemaVersion(1, nil)
+	tidbControl.SetResignDDLOwner(true, nil)
+
+	upgrader := NewTiDBUpgrader(tidbControl, podLister)
+	newSet := newTiDBUpgraderTestStatefulSet("ns", TiDBMemberName("tc"), 3, newRevision)
+
+	if err := upgrader.Upgrade(tc, nil, newSet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if newSet.Spec.UpdateStrategy.RollingUpdate == nil || newSet.Spec.UpdateStrategy.RollingUpdate.Partition == nil {
+		t.Fatalf("expected a partition to be set")
+	}
+	if got := *newSet.Spec.UpdateStrategy.RollingUpdate.Partition; got != 1 {
+		t.Errorf("expected partition 1 (the highest-ordinal pending pod), got %d", got)
+	}
+}
+
+func TestTiDBUpgraderBlocksOnSchemaVersionDivergence(t *testing.T) {
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+	pods := []*v1.Pod{
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-2", TiDBMemberName("tc")), newRevision),
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-1", TiDBMemberName("tc")), newRevision),
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-0", TiDBMemberName("tc")), oldRevision),
+	}
+	podLister := newTiDBUpgraderTestLister(pods...)
+
+	tidbControl := &diverganceFakeTiDBControl{FakeTiDBControl: NewFakeTiDBControl(), versions: map[int32]int64{2: 1, 1: 2}}
+
+	upgrader := NewTiDBUpgrader(tidbControl, podLister)
+	newSet := newTiDBUpgraderTestStatefulSet("ns", TiDBMemberName("tc"), 3, newRevision)
+
+	if err := upgrader.Upgrade(tc, nil, newSet); err == nil {
+		t.Fatal("expected an error blocking the restart while schema versions have not converged")
+	}
+}
+
+// diverganceFakeTiDBControl returns a distinct schema version per ordinal, to
+// exercise the non-convergence path that FakeTiDBControl's single version can't.
+type diverganceFakeTiDBControl struct {
+	*FakeTiDBControl
+	versions map[int32]int64
+}
+
+func (d *diverganceFakeTiDBControl) GetSchemaVersion(tc *v1alpha1.TidbCluster, ordinal int32) (int64, error) {
+	return d.versions[ordinal], nil
+}
+
+func TestTiDBUpgraderNoOpWhenAllPodsUpgraded(t *testing.T) {
+	tc := &v1alpha1.TidbCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tc"}}
+	pods := []*v1.Pod{
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-1", TiDBMemberName("tc")), newRevision),
+		newTiDBUpgraderTestPod("ns", fmt.Sprintf("%s-0", TiDBMemberName("tc")), newRevision),
+	}
+	podLister := newTiDBUpgraderTestLister(pods...)
+
+	tidbControl := NewFakeTiDBControl()
+	upgrader := NewTiDBUpgrader(tidbControl, podLister)
+	newSet := newTiDBUpgraderTestStatefulSet("ns", TiDBMemberName("tc"), 2, newRevision)
+
+	if err := upgrader.Upgrade(tc, nil, newSet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := *newSet.Spec.UpdateStrategy.RollingUpdate.Partition; got != 0 {
+		t.Errorf("expected partition 0 once every pod is upgraded, got %d", got)
+	}
+}
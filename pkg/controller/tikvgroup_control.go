@@ -15,25 +15,46 @@ package controller
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/pingcap/tidb-operator/pkg/apis/pingcap/v1alpha1"
 	"github.com/pingcap/tidb-operator/pkg/client/clientset/versioned"
 	listers "github.com/pingcap/tidb-operator/pkg/client/listers/pingcap/v1alpha1"
+	apps "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
 )
 
+// tikvGroupPartitionAnnotation mirrors the per-ordinal canary upgrade
+// annotation already supported on TidbCluster's `tikv.tidb.pingcap.com/partition`.
+const tikvGroupPartitionAnnotation = "tikvgroup.tidb.pingcap.com/partition"
+
 type TiKVGroupControlInterface interface {
 	UpdateTiKVGroup(*v1alpha1.TiKVGroup, *v1alpha1.TiKVGroupStatus, *v1alpha1.TiKVGroupStatus) (*v1alpha1.TiKVGroup, error)
+	// SetPartition sets the RollingUpdate.Partition of the StatefulSet backing tg to partition,
+	// so that only pods with ordinal >= partition are upgraded
+	SetPartition(tg *v1alpha1.TiKVGroup, partition int32) error
+	// ClearPartition clears any partition previously set on the StatefulSet backing tg,
+	// resuming a full rolling upgrade of all pods
+	ClearPartition(tg *v1alpha1.TiKVGroup) error
+	// SyncTiKVGroupPartition reads the tikvgroup.tidb.pingcap.com/partition annotation off tg,
+	// applies it to (or clears it from) the backing StatefulSet, and records the resulting
+	// observed partition and pending-upgrade ordinals on newStatus for UpdateTiKVGroup to persist.
+	SyncTiKVGroupPartition(tg *v1alpha1.TiKVGroup, newStatus *v1alpha1.TiKVGroupStatus) error
 }
 
 // NewRealTidbClusterControl creates a new TidbClusterControlInterface
-func NewRealTiKVGroupControl(cli versioned.Interface,
+func NewRealTiKVGroupControl(kubeCli kubernetes.Interface,
+	cli versioned.Interface,
 	tgLister listers.TiKVGroupLister,
 	recorder record.EventRecorder) TiKVGroupControlInterface {
 	return &realTiKVGroupControl{
+		kubeCli,
 		cli,
 		tgLister,
 		recorder,
@@ -41,6 +62,7 @@ func NewRealTiKVGroupControl(cli versioned.Interface,
 }
 
 type realTiKVGroupControl struct {
+	kubeCli  kubernetes.Interface
 	cli      versioned.Interface
 	tgLister listers.TiKVGroupLister
 	recorder record.EventRecorder
@@ -50,11 +72,24 @@ func (rtc *realTiKVGroupControl) UpdateTiKVGroup(tg *v1alpha1.TiKVGroup, newStat
 	ns := tg.GetNamespace()
 	name := tg.GetName()
 
-	status := tg.Status.DeepCopy()
+	// newStatus must be a deep copy of the previously observed status with the
+	// caller's updates layered on top (as tc.Status.DeepCopy() callers elsewhere
+	// in this package do), since it fully replaces what gets persisted below;
+	// a partial/sparse newStatus would silently drop fields the caller didn't set.
+	status := newStatus.DeepCopy()
+	status.Strategies = mergeStrategyList(oldStatus.Strategies, newStatus.Strategies)
+	// Diff and emit transition events exactly once, against the oldStatus this
+	// call started with. Doing this inside the retry closure instead would
+	// re-emit the same "transitioned from X to Y" event on every conflict retry,
+	// since each retry re-merges against whatever the lister returns, not
+	// against whether we ourselves already reported the transition.
+	emitStrategyTransitionEvents(rtc.recorder, tg, oldStatus.Strategies, status.Strategies)
+
 	var updateTg *v1alpha1.TiKVGroup
 
 	// don't wait due to limited number of clients, but backoff after the default number of steps
 	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		tg.Status = *status
 		var updateErr error
 		updateTg, updateErr = rtc.cli.PingcapV1alpha1().TiKVGroups(ns).Update(tg)
 		if updateErr == nil {
@@ -66,6 +101,11 @@ func (rtc *realTiKVGroupControl) UpdateTiKVGroup(tg *v1alpha1.TiKVGroup, newStat
 		if updated, err := rtc.tgLister.TiKVGroups(ns).Get(name); err == nil {
 			// make a copy so we don't mutate the shared cache
 			tg = updated.DeepCopy()
+			// re-merge against the freshly fetched status instead of blindly
+			// overwriting it, otherwise we would clobber strategy entries
+			// written by a concurrent reconcile of a different subsystem. No
+			// events are (re-)emitted here, they were already computed once above.
+			status.Strategies = mergeStrategyList(tg.Status.Strategies, newStatus.Strategies)
 			tg.Status = *status
 		} else {
 			utilruntime.HandleError(fmt.Errorf("error getting updated TiKVGroup %s/%s from lister: %v", ns, name, err))
@@ -75,3 +115,165 @@ func (rtc *realTiKVGroupControl) UpdateTiKVGroup(tg *v1alpha1.TiKVGroup, newStat
 	})
 	return updateTg, err
 }
+
+func (rtc *realTiKVGroupControl) SetPartition(tg *v1alpha1.TiKVGroup, partition int32) error {
+	return rtc.updatePartition(tg, &partition)
+}
+
+func (rtc *realTiKVGroupControl) ClearPartition(tg *v1alpha1.TiKVGroup) error {
+	return rtc.updatePartition(tg, nil)
+}
+
+// updatePartition sets or clears RollingUpdate.Partition on the StatefulSet backing tg,
+// so a TiKVGroup can be canary-upgraded ordinal by ordinal the same way TidbCluster already is
+// via the tikv.tidb.pingcap.com/partition annotation.
+func (rtc *realTiKVGroupControl) updatePartition(tg *v1alpha1.TiKVGroup, partition *int32) error {
+	ns := tg.GetNamespace()
+	name := tg.GetName()
+	setName := TiKVGroupMemberName(name)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		set, err := rtc.kubeCli.AppsV1().StatefulSets(ns).Get(setName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if set.Spec.UpdateStrategy.RollingUpdate == nil {
+			set.Spec.UpdateStrategy.RollingUpdate = &apps.RollingUpdateStatefulSetStrategy{}
+		}
+		set.Spec.UpdateStrategy.RollingUpdate.Partition = partition
+
+		_, err = rtc.kubeCli.AppsV1().StatefulSets(ns).Update(set)
+		if err != nil {
+			return err
+		}
+		if partition == nil {
+			klog.Infof("TiKVGroup: [%s/%s] cleared partition on StatefulSet %s", ns, name, setName)
+		} else {
+			klog.Infof("TiKVGroup: [%s/%s] set partition on StatefulSet %s to %d", ns, name, setName, *partition)
+		}
+		return nil
+	})
+}
+
+// SyncTiKVGroupPartition is the canary-upgrade entry point a TiKVGroup reconciler
+// calls on every reconcile: it applies the tikvgroup.tidb.pingcap.com/partition
+// annotation (if present) to the backing StatefulSet, or clears any previously set
+// partition if the annotation has been removed, and surfaces the result onto newStatus.
+func (rtc *realTiKVGroupControl) SyncTiKVGroupPartition(tg *v1alpha1.TiKVGroup, newStatus *v1alpha1.TiKVGroupStatus) error {
+	ns := tg.GetNamespace()
+	name := tg.GetName()
+	setName := TiKVGroupMemberName(name)
+
+	if raw, ok := tg.Annotations[tikvGroupPartitionAnnotation]; ok {
+		partition, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil || partition < 0 {
+			return fmt.Errorf("invalid %s annotation %q on TiKVGroup %s/%s: must be a non-negative integer", tikvGroupPartitionAnnotation, raw, ns, name)
+		}
+		if err := rtc.SetPartition(tg, int32(partition)); err != nil {
+			return err
+		}
+	} else {
+		if err := rtc.ClearPartition(tg); err != nil {
+			return err
+		}
+	}
+
+	set, err := rtc.kubeCli.AppsV1().StatefulSets(ns).Get(setName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var partition int32
+	if set.Spec.UpdateStrategy.RollingUpdate != nil && set.Spec.UpdateStrategy.RollingUpdate.Partition != nil {
+		partition = *set.Spec.UpdateStrategy.RollingUpdate.Partition
+	}
+	newStatus.Partition = partition
+	newStatus.PendingOrdinals = pendingUpgradeOrdinals(set)
+
+	return nil
+}
+
+// pendingUpgradeOrdinals returns the ordinals held back by partition, i.e. those
+// that will not be upgraded until the partition is lowered past them.
+func pendingUpgradeOrdinals(set *apps.StatefulSet) []int32 {
+	if set.Spec.UpdateStrategy.RollingUpdate == nil || set.Spec.UpdateStrategy.RollingUpdate.Partition == nil {
+		return nil
+	}
+	partition := *set.Spec.UpdateStrategy.RollingUpdate.Partition
+	replicas := int32(0)
+	if set.Spec.Replicas != nil {
+		replicas = *set.Spec.Replicas
+	}
+	if partition > replicas {
+		partition = replicas
+	}
+	pending := make([]int32, 0, partition)
+	for i := int32(0); i < partition; i++ {
+		pending = append(pending, i)
+	}
+	return pending
+}
+
+// mergeStrategyList merges incoming strategy statuses into the existing list,
+// replacing any entry whose Type matches. LastUpdateTime is preserved when a
+// merged entry is otherwise unchanged. This is a pure function: it must not
+// have side effects (such as emitting events), since UpdateTiKVGroup calls it
+// again on every conflict retry to re-merge against the freshly fetched object.
+func mergeStrategyList(old, new []v1alpha1.StrategyStatus) []v1alpha1.StrategyStatus {
+	merged := make([]v1alpha1.StrategyStatus, 0, len(old)+len(new))
+	byType := make(map[v1alpha1.StrategyType]int, len(old))
+	for _, s := range old {
+		byType[s.Type] = len(merged)
+		merged = append(merged, s)
+	}
+
+	for _, n := range new {
+		n := n
+		if idx, ok := byType[n.Type]; ok {
+			prev := merged[idx]
+			if prev.Status == n.Status && prev.Reason == n.Reason && prev.Message == n.Message {
+				n.LastUpdateTime = prev.LastUpdateTime
+			} else if n.LastUpdateTime.IsZero() {
+				n.LastUpdateTime = metav1.Now()
+			}
+			merged[idx] = n
+			continue
+		}
+
+		if n.LastUpdateTime.IsZero() {
+			n.LastUpdateTime = metav1.Now()
+		}
+		byType[n.Type] = len(merged)
+		merged = append(merged, n)
+	}
+
+	return merged
+}
+
+// emitStrategyTransitionEvents diffs merged against old (the status persisted before
+// this UpdateTiKVGroup call began) and emits one Kubernetes event per strategy Type
+// whose Status actually changed. It is called exactly once per UpdateTiKVGroup call,
+// never from inside the conflict-retry loop, so a transition is never reported twice.
+func emitStrategyTransitionEvents(recorder record.EventRecorder, tg *v1alpha1.TiKVGroup, old, merged []v1alpha1.StrategyStatus) {
+	prevByType := make(map[v1alpha1.StrategyType]v1alpha1.StrategyStatus, len(old))
+	for _, s := range old {
+		prevByType[s.Type] = s
+	}
+
+	for _, cur := range merged {
+		prev, existed := prevByType[cur.Type]
+		if existed && prev.Status == cur.Status {
+			continue
+		}
+		recordStrategyTransition(recorder, tg, prev, cur)
+	}
+}
+
+func recordStrategyTransition(recorder record.EventRecorder, tg *v1alpha1.TiKVGroup, prev, cur v1alpha1.StrategyStatus) {
+	eventType := v1.EventTypeNormal
+	if cur.Status == v1alpha1.StrategyStatusError {
+		eventType = v1.EventTypeWarning
+	}
+	recorder.Eventf(tg, eventType, string(cur.Type), "strategy %s transitioned from %s to %s: %s", cur.Type, prev.Status, cur.Status, cur.Message)
+}
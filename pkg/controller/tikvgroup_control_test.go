@@ -0,0 +1,307 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb-operator/pkg/apis/pingcap/v1alpha1"
+	versionedfake "github.com/pingcap/tidb-operator/pkg/client/clientset/versioned/fake"
+	listers "github.com/pingcap/tidb-operator/pkg/client/listers/pingcap/v1alpha1"
+	apps "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func newTestStatefulSet(ns, name string, replicas, partition int32) *apps.StatefulSet {
+	set := &apps.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec: apps.StatefulSetSpec{
+			Replicas: &replicas,
+		},
+	}
+	if partition > 0 {
+		set.Spec.UpdateStrategy.RollingUpdate = &apps.RollingUpdateStatefulSetStrategy{Partition: &partition}
+	}
+	return set
+}
+
+func TestMergeStrategyListPreservesLastUpdateTimeWhenUnchanged(t *testing.T) {
+	oldTime := metav1.NewTime(time.Unix(100, 0))
+	old := []v1alpha1.StrategyStatus{
+		{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusSuccess, LastUpdateTime: oldTime},
+	}
+	new := []v1alpha1.StrategyStatus{
+		{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusSuccess},
+		{Type: v1alpha1.StrategyTypeRollingUpgrade, Status: v1alpha1.StrategyStatusPending},
+	}
+
+	merged := mergeStrategyList(old, new)
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 merged entries, got %d", len(merged))
+	}
+	if !merged[0].LastUpdateTime.Equal(&oldTime) {
+		t.Errorf("expected unchanged strategy to preserve LastUpdateTime %v, got %v", oldTime, merged[0].LastUpdateTime)
+	}
+	if merged[1].LastUpdateTime.IsZero() {
+		t.Errorf("expected newly added strategy to get a stamped LastUpdateTime")
+	}
+}
+
+func TestMergeStrategyListReplacesMatchingType(t *testing.T) {
+	old := []v1alpha1.StrategyStatus{
+		{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusError, Message: "pd unreachable"},
+	}
+	new := []v1alpha1.StrategyStatus{
+		{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusSuccess},
+	}
+
+	merged := mergeStrategyList(old, new)
+	if len(merged) != 1 {
+		t.Fatalf("expected the matching type to be replaced in place, got %d entries", len(merged))
+	}
+	if merged[0].Status != v1alpha1.StrategyStatusSuccess {
+		t.Errorf("expected merged status to be %s, got %s", v1alpha1.StrategyStatusSuccess, merged[0].Status)
+	}
+}
+
+// TestEmitStrategyTransitionEventsNotDuplicatedAcrossRetries guards the bug where
+// re-running the merge on every conflict retry also re-emitted the same transition
+// event. Events must be computed once against the status the call started with.
+func TestEmitStrategyTransitionEventsNotDuplicatedAcrossRetries(t *testing.T) {
+	tg := &v1alpha1.TiKVGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tg"}}
+	recorder := record.NewFakeRecorder(10)
+
+	old := []v1alpha1.StrategyStatus{{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusPending}}
+	merged := []v1alpha1.StrategyStatus{{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusSuccess}}
+
+	// simulate several conflict-retry attempts re-deriving the same merged list;
+	// mergeStrategyList itself must never emit events
+	for i := 0; i < 3; i++ {
+		_ = mergeStrategyList(old, merged)
+	}
+
+	// the caller emits events exactly once, regardless of how many retries happened
+	emitStrategyTransitionEvents(recorder, tg, old, merged)
+
+	close(recorder.Events)
+	count := 0
+	for range recorder.Events {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected exactly 1 event for the single transition, got %d", count)
+	}
+}
+
+func TestEmitStrategyTransitionEventsSkipsUnchanged(t *testing.T) {
+	tg := &v1alpha1.TiKVGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tg"}}
+	recorder := record.NewFakeRecorder(10)
+
+	same := []v1alpha1.StrategyStatus{{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusSuccess}}
+
+	emitStrategyTransitionEvents(recorder, tg, same, same)
+
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("expected no event for an unchanged strategy status, got %q", e)
+	default:
+	}
+}
+
+// TestUpdateTiKVGroupRetriesOnConflictAndEmitsEventOnce drives UpdateTiKVGroup
+// itself through one real conflict: the first Update call fails with a
+// Conflict error, forcing the retry loop to re-fetch from the lister and
+// re-merge against whatever a concurrent reconcile already persisted there.
+// It asserts the final persisted Strategies reflect both the concurrent write
+// and the caller's own update, and that only one event is ever emitted.
+func TestUpdateTiKVGroupRetriesOnConflictAndEmitsEventOnce(t *testing.T) {
+	ns := "ns"
+	name := "tg"
+	tg := &v1alpha1.TiKVGroup{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+
+	cli := versionedfake.NewSimpleClientset(tg.DeepCopy())
+	conflicted := false
+	cli.PrependReactor("update", "tikvgroups", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if !conflicted {
+			conflicted = true
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "tikvgroups"}, name, fmt.Errorf("conflict"))
+		}
+		return false, nil, nil
+	})
+
+	// the object a concurrent reconcile already persisted by the time our retry
+	// re-fetches from the lister
+	concurrentlyUpdated := tg.DeepCopy()
+	concurrentlyUpdated.Status.Strategies = []v1alpha1.StrategyStatus{
+		{Type: v1alpha1.StrategyTypeSyncPD, Status: v1alpha1.StrategyStatusSuccess},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(concurrentlyUpdated); err != nil {
+		t.Fatalf("failed to seed lister: %v", err)
+	}
+	tgLister := listers.NewTiKVGroupLister(indexer)
+
+	recorder := record.NewFakeRecorder(10)
+	rtc := NewRealTiKVGroupControl(nil, cli, tgLister, recorder)
+
+	oldStatus := tg.Status.DeepCopy()
+	newStatus := tg.Status.DeepCopy()
+	newStatus.Strategies = []v1alpha1.StrategyStatus{
+		{Type: v1alpha1.StrategyTypeRollingUpgrade, Status: v1alpha1.StrategyStatusSuccess},
+	}
+
+	updated, err := rtc.UpdateTiKVGroup(tg, newStatus, oldStatus)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var foundSyncPD, foundRolling bool
+	for _, s := range updated.Status.Strategies {
+		switch s.Type {
+		case v1alpha1.StrategyTypeSyncPD:
+			foundSyncPD = true
+		case v1alpha1.StrategyTypeRollingUpgrade:
+			foundRolling = true
+		}
+	}
+	if !foundSyncPD {
+		t.Error("expected the concurrently-persisted SyncPD strategy to survive the retry re-merge")
+	}
+	if !foundRolling {
+		t.Error("expected the caller's RollingUpgrade strategy to be persisted")
+	}
+
+	close(recorder.Events)
+	count := 0
+	for range recorder.Events {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected exactly 1 event end-to-end despite the conflict retry, got %d", count)
+	}
+}
+
+func TestPendingUpgradeOrdinals(t *testing.T) {
+	set := newTestStatefulSet("ns", "tg-tikv", 5, 3)
+	pending := pendingUpgradeOrdinals(set)
+	expected := []int32{0, 1, 2}
+	if len(pending) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, pending)
+	}
+	for i, o := range expected {
+		if pending[i] != o {
+			t.Errorf("expected ordinal %d at index %d, got %d", o, i, pending[i])
+		}
+	}
+}
+
+func TestPendingUpgradeOrdinalsNoPartition(t *testing.T) {
+	set := newTestStatefulSet("ns", "tg-tikv", 5, 0)
+	if pending := pendingUpgradeOrdinals(set); pending != nil {
+		t.Errorf("expected no pending ordinals without a partition, got %v", pending)
+	}
+}
+
+func TestSyncTiKVGroupPartitionSetsFromAnnotation(t *testing.T) {
+	tg := &v1alpha1.TiKVGroup{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        "tg",
+			Annotations: map[string]string{tikvGroupPartitionAnnotation: "2"},
+		},
+	}
+	set := newTestStatefulSet("ns", TiKVGroupMemberName("tg"), 5, 0)
+	kubeCli := kubefake.NewSimpleClientset(set)
+	rtc := &realTiKVGroupControl{kubeCli: kubeCli}
+
+	status := &v1alpha1.TiKVGroupStatus{}
+	if err := rtc.SyncTiKVGroupPartition(tg, status); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Partition != 2 {
+		t.Errorf("expected status.Partition 2, got %d", status.Partition)
+	}
+	if len(status.PendingOrdinals) != 2 || status.PendingOrdinals[0] != 0 || status.PendingOrdinals[1] != 1 {
+		t.Errorf("expected pending ordinals [0 1], got %v", status.PendingOrdinals)
+	}
+}
+
+func TestSyncTiKVGroupPartitionClearsWithoutAnnotation(t *testing.T) {
+	tg := &v1alpha1.TiKVGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tg"}}
+	set := newTestStatefulSet("ns", TiKVGroupMemberName("tg"), 5, 3)
+	kubeCli := kubefake.NewSimpleClientset(set)
+	rtc := &realTiKVGroupControl{kubeCli: kubeCli}
+
+	status := &v1alpha1.TiKVGroupStatus{}
+	if err := rtc.SyncTiKVGroupPartition(tg, status); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Partition != 0 {
+		t.Errorf("expected status.Partition to be cleared to 0, got %d", status.Partition)
+	}
+	if status.PendingOrdinals != nil {
+		t.Errorf("expected no pending ordinals once the partition is cleared, got %v", status.PendingOrdinals)
+	}
+}
+
+func TestSyncTiKVGroupPartitionInvalidAnnotation(t *testing.T) {
+	tg := &v1alpha1.TiKVGroup{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        "tg",
+			Annotations: map[string]string{tikvGroupPartitionAnnotation: "not-a-number"},
+		},
+	}
+	set := newTestStatefulSet("ns", TiKVGroupMemberName("tg"), 5, 0)
+	kubeCli := kubefake.NewSimpleClientset(set)
+	rtc := &realTiKVGroupControl{kubeCli: kubeCli}
+
+	if err := rtc.SyncTiKVGroupPartition(tg, &v1alpha1.TiKVGroupStatus{}); err == nil {
+		t.Error("expected an error for a non-numeric partition annotation")
+	}
+}
+
+func TestSyncTiKVGroupPartitionRejectsNegativeAnnotation(t *testing.T) {
+	tg := &v1alpha1.TiKVGroup{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        "tg",
+			Annotations: map[string]string{tikvGroupPartitionAnnotation: "-1"},
+		},
+	}
+	set := newTestStatefulSet("ns", TiKVGroupMemberName("tg"), 5, 0)
+	kubeCli := kubefake.NewSimpleClientset(set)
+	rtc := &realTiKVGroupControl{kubeCli: kubeCli}
+
+	if err := rtc.SyncTiKVGroupPartition(tg, &v1alpha1.TiKVGroupStatus{}); err == nil {
+		t.Error("expected an error for a negative partition annotation")
+	}
+
+	got, err := kubeCli.AppsV1().StatefulSets("ns").Get(TiKVGroupMemberName("tg"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Spec.UpdateStrategy.RollingUpdate != nil && got.Spec.UpdateStrategy.RollingUpdate.Partition != nil {
+		t.Errorf("expected the negative partition to never reach the StatefulSet, got %d", *got.Spec.UpdateStrategy.RollingUpdate.Partition)
+	}
+}